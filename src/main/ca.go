@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mitm"
+	"os"
+	"time"
+)
+
+const (
+	defaultCAKeyFile  = "gomitmproxy-ca-pk.pem"
+	defaultCACertFile = "gomitmproxy-ca-cert.pem"
+)
+
+const caUsage = `usage: gomitmproxy ca <command> [flags]
+
+commands:
+  init    create a CA
+  show    print the subject, fingerprint and expiry of the CA
+  export  write the CA certificate as PEM, DER or PKCS#12
+  rotate  replace the CA, the old files are kept with a .old suffix
+
+run gomitmproxy ca <command> -h for the flags of a command
+`
+
+// caMain runs the ca subcommand with the arguments following "ca".
+func caMain(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		return fmt.Errorf("missing ca command")
+	}
+	switch args[0] {
+	case "init":
+		return caInit(args[1:])
+	case "show":
+		return caShow(args[1:])
+	case "export":
+		return caExport(args[1:])
+	case "rotate":
+		return caRotate(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stderr, caUsage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, caUsage)
+	return fmt.Errorf("unknown ca command %q", args[0])
+}
+
+func caFlags(name string) (fs *flag.FlagSet, keyFile, certFile *string) {
+	fs = flag.NewFlagSet("ca "+name, flag.ExitOnError)
+	keyFile = fs.String("caKey", defaultCAKeyFile, "CA private key file")
+	certFile = fs.String("caCert", defaultCACertFile, "CA certificate file")
+	return
+}
+
+func caInit(args []string) error {
+	fs, keyFile, certFile := caFlags("init")
+	org := fs.String("org", "gomitmproxy"+mitm.Version, "subject organization")
+	cn := fs.String("cn", "gomitmproxy", "subject common name")
+	alg := fs.String("key", mitm.KEY_RSA2048, "key algorithm: rsa2048, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	days := fs.Int("days", 365, "lifetime in days")
+	force := fs.Bool("force", false, "overwrite existing files")
+	fs.Parse(args)
+
+	if !*force {
+		for _, name := range []string{*keyFile, *certFile} {
+			if _, err := os.Stat(name); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite it or ca rotate to replace the CA", name)
+			}
+		}
+	}
+	key, cert, err := mitm.CreateCA(mitm.CAOptions{
+		Organization: *org,
+		CommonName:   *cn,
+		KeyAlgorithm: *alg,
+		Lifetime:     time.Duration(*days) * 24 * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+	if err = mitm.WriteCA(key, cert, *keyFile, *certFile); err != nil {
+		return err
+	}
+	printCA(key, cert)
+	return nil
+}
+
+func caShow(args []string) error {
+	fs, keyFile, certFile := caFlags("show")
+	fs.Parse(args)
+
+	key, cert, err := mitm.LoadCA(*keyFile, *certFile)
+	if err != nil {
+		return err
+	}
+	printCA(key, cert)
+	return nil
+}
+
+func caExport(args []string) error {
+	fs, keyFile, certFile := caFlags("export")
+	format := fs.String("format", "pem", "output format: pem, der or p12")
+	out := fs.String("out", "", "output file, required for der and p12, stdout for pem when empty")
+	withKey := fs.Bool("withKey", false, "include the private key, pem and p12 only")
+	password := fs.String("password", "", "password of the PKCS#12 file")
+	name := fs.String("name", "gomitmproxy", "friendly name of the PKCS#12 file")
+	fs.Parse(args)
+
+	key, cert, err := mitm.LoadCA(*keyFile, *certFile)
+	if err != nil {
+		return err
+	}
+	if *out == "" && *format != "pem" {
+		return fmt.Errorf("-out is required for the %s format", *format)
+	}
+	var data []byte
+	switch *format {
+	case "pem":
+		data = cert.PEMEncoded()
+		if *withKey {
+			data = append(data, key.PEMEncoded()...)
+		}
+	case "der":
+		if *withKey {
+			return fmt.Errorf("the der format only holds the certificate, use pem or p12 with -withKey")
+		}
+		return cert.WriteToDERFile(*out)
+	case "p12":
+		if !*withKey {
+			key = nil
+		}
+		if data, err = mitm.EncodePKCS12(cert, key, *name, *password); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	mode := os.FileMode(0644)
+	if *withKey {
+		mode = 0600
+	}
+	return ioutil.WriteFile(*out, data, mode)
+}
+
+func caRotate(args []string) error {
+	fs, keyFile, certFile := caFlags("rotate")
+	org := fs.String("org", "", "subject organization, the one of the current CA when empty")
+	cn := fs.String("cn", "", "subject common name, the one of the current CA when empty")
+	alg := fs.String("key", "", "key algorithm, the one of the current CA when empty")
+	days := fs.Int("days", 365, "lifetime in days")
+	fs.Parse(args)
+
+	oldKey, oldCert, err := mitm.LoadCA(*keyFile, *certFile)
+	if err != nil {
+		return err
+	}
+	subject := oldCert.X509().Subject
+	if *org == "" && len(subject.Organization) > 0 {
+		*org = subject.Organization[0]
+	}
+	if *cn == "" {
+		*cn = subject.CommonName
+	}
+	if *alg == "" {
+		*alg = oldKey.Algorithm()
+	}
+	key, cert, err := mitm.CreateCA(mitm.CAOptions{
+		Organization: *org,
+		CommonName:   *cn,
+		KeyAlgorithm: *alg,
+		Lifetime:     time.Duration(*days) * 24 * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+	files := []string{*keyFile, *certFile}
+	for _, name := range files {
+		if _, err = os.Lstat(name + ".old"); err == nil {
+			return fmt.Errorf("%s.old exists, move the previous backup away before rotating again", name)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// on failure the renamed files are put back, the pair is never left
+	// half rotated
+	var renamed []string
+	restore := func() {
+		for _, name := range renamed {
+			if err := os.Rename(name+".old", name); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to restore %s from %s.old: %s\n", name, name, err)
+			}
+		}
+	}
+	for _, name := range files {
+		if err = os.Rename(name, name+".old"); err != nil {
+			restore()
+			return fmt.Errorf("Unable to back up %s: %s", name, err)
+		}
+		renamed = append(renamed, name)
+	}
+	if err = mitm.WriteCA(key, cert, *keyFile, *certFile); err != nil {
+		restore()
+		return err
+	}
+	fmt.Printf("old CA kept as %s.old and %s.old, fingerprint %s\n", *keyFile, *certFile, oldCert.Fingerprint())
+	printCA(key, cert)
+	fmt.Println("clients must trust the new CA certificate before they can be intercepted again")
+	return nil
+}
+
+func printCA(key *mitm.PrivateKey, cert *mitm.Certificate) {
+	x := cert.X509()
+	fmt.Printf("subject:     %s\n", x.Subject)
+	fmt.Printf("key:         %s\n", key.Algorithm())
+	fmt.Printf("fingerprint: SHA256 %s\n", cert.Fingerprint())
+	fmt.Printf("not before:  %s\n", x.NotBefore.Format(time.RFC3339))
+	fmt.Printf("not after:   %s (%d days left)\n", x.NotAfter.Format(time.RFC3339),
+		int(time.Until(x.NotAfter).Hours()/24))
+}
@@ -2,15 +2,29 @@ package main
 
 import (
 	"config"
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"mitm"
 	"mylog"
+	"net"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := caMain(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var log io.WriteCloser
 	var err error
 	// cofig
@@ -20,6 +34,41 @@ func main() {
 	conf.Log = flag.String("logFile", "", "log file path")
 	conf.Monitor = flag.Bool("m", false, "monitor mode")
 	conf.Tls = flag.Bool("tls", false, "tls connect")
+	conf.Chain = flag.Bool("chain", false, "intercept traffic and use -raddr as parent proxy")
+	conf.RaddrAuth = flag.String("raddrAuth", "", "user:password for the parent proxy")
+	conf.SocksAddr = flag.String("socks", "", "SOCKS5 listen address, e.g. :1080")
+	conf.SocksAuth = flag.String("socksAuth", "", "user:password required from SOCKS5 clients")
+	conf.MaxIdleConnsPerHost = flag.Int("maxIdleConnsPerHost", 16, "idle upstream connections kept per host")
+	conf.MaxConnsPerHost = flag.Int("maxConnsPerHost", 0, "max upstream connections per host, 0 means no limit")
+	conf.UpstreamTimeout = flag.Duration("upstreamTimeout", 30*time.Second, "upstream dial and response header timeout")
+	conf.MaxCaptureSize = flag.Int64("maxCapture", 1<<20, "max bytes of each body kept in monitor mode")
+	flag.Var(&conf.Listeners, "listen", "listeners as mode=addr[>target], repeatable, modes: "+
+		"http, tls, forward, socks5, reverse, transparent (Linux), e.g. -listen http=:8080 -listen reverse=:8081>http://127.0.0.1:3000")
+	conf.HarFile = flag.String("har", "", "write captured flows to this HAR file on exit or SIGUSR1")
+	conf.MapRulesFile = flag.String("mapRules", "", "JSON file of Map Local / Map Remote rules")
+	flag.Var(&conf.Scripts, "script", "Starlark script defining request(flow) and response(flow) hooks, repeatable")
+	flag.Var(&conf.BreakRequests, "breakRequest", "hold requests matching this URL pattern before they go upstream, repeatable")
+	flag.Var(&conf.BreakResponses, "breakResponse", "hold responses to requests matching this URL pattern before they go to the client, repeatable")
+	conf.BreakTimeout = flag.Duration("breakTimeout", 5*time.Minute, "resume held flows after this long, 0 means never")
+	conf.BreakAPI = flag.String("breakAPI", "127.0.0.1:9090", "listen address of the API listing, editing, resuming and killing held flows")
+	conf.MirrorCert = flag.Bool("mirrorCert", false, "copy SANs, validity and key usages of the upstream certificate into forged ones")
+	conf.LeafKey = flag.String("leafKey", config.LeafKeyCA, "key of forged certificates: ca (reuse the CA key), "+
+		"rsa2048, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	conf.CertCacheSize = flag.Int("certCacheSize", 10000, "forged certificates kept in memory, 0 means no limit")
+	conf.CertDir = flag.String("certDir", "", "directory persisting forged certificates, and a generated leaf key, across restarts")
+	flag.Var(&conf.ClientCerts, "clientCert", "client certificate for matching upstreams as pattern=cert.pem[,key.pem], repeatable, "+
+		"pattern is a host, *.domain or *, optionally with :port")
+	conf.RequestClientCert = flag.Bool("requestClientCert", false, "ask clients for a TLS certificate and record it in the flows")
+	conf.UpstreamVerify = flag.String("upstreamVerify", config.VerifySystem, "upstream certificate verification: "+
+		"system (system roots plus -upstreamCA), bundle (only -upstreamCA) or insecure")
+	conf.UpstreamCA = flag.String("upstreamCA", "", "PEM bundle of CA certificates trusted for upstream servers")
+	flag.Var(&conf.UpstreamPins, "upstreamPin", "accept matching upstreams by public key as pattern=sha256/BASE64, repeatable")
+	conf.HTTP2 = flag.Bool("http2", true, "speak HTTP/2 with clients and upstream servers that support it")
+	downstreamTLS := flag.String("downstreamTLS", config.TLSIntermediate, "TLS profile offered to clients: modern, intermediate or legacy")
+	upstreamTLS := flag.String("upstreamTLS", config.TLSIntermediate, "TLS profile used with upstream servers: modern, intermediate or legacy")
+	caKey := flag.String("caKey", defaultCAKeyFile, "CA private key file, see gomitmproxy ca")
+	caCert := flag.String("caCert", defaultCACertFile, "CA certificate file, see gomitmproxy ca")
+	shutdownTimeout := flag.Duration("shutdownTimeout", 10*time.Second, "time given to in-flight flows on SIGINT/SIGTERM")
 
 	flag.Parse()
 
@@ -34,11 +83,123 @@ func main() {
 	}
 	mylog.SetLog(log)
 
+	var addons []mitm.Addon
+	if *conf.MapRulesFile != "" {
+		rules, err := config.LoadMapRules(*conf.MapRulesFile)
+		if err != nil {
+			mylog.Fatalf("%s", err)
+		}
+		mapper, err := mitm.NewMapper(rules)
+		if err != nil {
+			mylog.Fatalf("%s", err)
+		}
+		addons = append(addons, mapper)
+	}
+	for _, filename := range conf.Scripts {
+		script, err := mitm.LoadScript(filename)
+		if err != nil {
+			mylog.Fatalf("%s", err)
+		}
+		addons = append(addons, script)
+	}
+	var breakpoints *mitm.Breakpoints
+	var breakAPI *http.Server
+	var breakListener net.Listener
+	if len(conf.BreakRequests)+len(conf.BreakResponses) > 0 {
+		breakpoints = mitm.NewBreakpoints(conf.BreakRequests, conf.BreakResponses, *conf.BreakTimeout)
+		addons = append(addons, breakpoints)
+		// bound before the proxy starts, a taken address fails the startup
+		if breakListener, err = net.Listen("tcp", *conf.BreakAPI); err != nil {
+			mylog.Fatalf("Unable to listen for the breakpoint API: %s", err)
+		}
+		breakAPI = &http.Server{Handler: breakpoints}
+	}
+	var har *mitm.HARRecorder
+	if *conf.HarFile != "" {
+		har = mitm.NewHARRecorder()
+		addons = append(addons, har)
+	}
+
 	// init tls config
-	tlsConfig := config.NewTlsConfig("gomitmproxy-ca-pk.pem", "gomitmproxy-ca-cert.pem", "", "")
+	tlsConfig := config.NewTlsConfig(*caKey, *caCert, "", "")
+	if err = tlsConfig.SetProfiles(*downstreamTLS, *upstreamTLS); err != nil {
+		mylog.Fatalf("%s", err)
+	}
 	// start mitm proxy
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	mitm.Gomitmproxy(conf, tlsConfig, wg)
-	wg.Wait()
+	server, err := mitm.NewServer(conf, tlsConfig, addons...)
+	if err != nil {
+		mylog.Fatalf("InitConfig error: %s", err)
+	}
+	if err = server.Start(); err != nil {
+		mylog.Fatalf("%s", err)
+	}
+	if breakAPI != nil {
+		go serveBreakAPI(breakAPI, breakListener)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	save := make(chan os.Signal, 1)
+	notifySave(save)
+	for {
+		select {
+		case <-save:
+			saveHAR(har, *conf.HarFile)
+		case <-stop:
+			mylog.Printf("Shutting down, waiting up to %s for flows in progress", *shutdownTimeout)
+			stopBreakpoints(breakpoints, breakAPI)
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := server.Shutdown(ctx); err != nil {
+				mylog.Println("shutdown error:", err)
+			}
+			cancel()
+			saveHAR(har, *conf.HarFile)
+			logCertStats(server)
+			mylog.Printf("Gomitmproxy Stop!!!!")
+			return
+		case <-server.Done():
+			if err := server.Err(); err != nil {
+				mylog.Println("proxy stopped:", err)
+			}
+			stopBreakpoints(breakpoints, breakAPI)
+			saveHAR(har, *conf.HarFile)
+			logCertStats(server)
+			mylog.Printf("Gomitmproxy Stop!!!!")
+			return
+		}
+	}
+}
+
+func logCertStats(server *mitm.Server) {
+	stats := server.Handler.CertCache().Stats()
+	mylog.Printf("certificate cache: %d entries, %d hits, %d misses, %d evictions",
+		stats.Entries, stats.Hits, stats.Misses, stats.Evictions)
+}
+
+func serveBreakAPI(api *http.Server, l net.Listener) {
+	mylog.Printf("breakpoint API listening on http://%s/flows", l.Addr())
+	if err := api.Serve(l); err != http.ErrServerClosed {
+		mylog.Println("breakpoint API error:", err)
+	}
+}
+
+// stopBreakpoints closes the breakpoint API and lets the held flows go on,
+// so that shutting down does not wait for them.
+func stopBreakpoints(breakpoints *mitm.Breakpoints, api *http.Server) {
+	if breakpoints == nil {
+		return
+	}
+	api.Close()
+	breakpoints.Close()
+}
+
+func saveHAR(har *mitm.HARRecorder, filename string) {
+	if har == nil {
+		return
+	}
+	if err := har.WriteToFile(filename); err != nil {
+		mylog.Println("write har error:", err)
+		return
+	}
+	mylog.Printf("HAR written to %s", filename)
 }
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySave relays the signal asking for the HAR archive to be written.
+func notifySave(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// notifySave does nothing, there is no SIGUSR1 on windows.
+func notifySave(c chan<- os.Signal) {}